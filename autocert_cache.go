@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"golang.org/x/crypto/acme/autocert"
+	"google.golang.org/api/option"
+)
+
+// newAutocertCache builds the autocert.Cache backend selected by spec.
+// spec is either a bare filesystem directory (the default "file"
+// behavior), or a "gcs://bucket/prefix" or "s3://bucket/prefix" URL for
+// cache storage that survives container/host restarts.
+func newAutocertCache(spec string) (autocert.Cache, error) {
+	u, err := url.Parse(spec)
+	if err != nil || len(u.Scheme) == 0 {
+		return autocert.DirCache(spec), nil
+	}
+
+	bucket := u.Host
+	prefix := strings.TrimPrefix(u.Path, "/")
+
+	switch u.Scheme {
+	case "gcs":
+		return newGCSCache(bucket, prefix)
+	case "s3":
+		return newS3Cache(bucket, prefix)
+	default:
+		return nil, fmt.Errorf("gopkgredir: unknown cache-backend scheme %q", u.Scheme)
+	}
+}
+
+func cacheKey(prefix, key string) string {
+	if len(prefix) == 0 {
+		return key
+	}
+	return prefix + "/" + key
+}
+
+// gcsCache stores autocert cache entries as objects in a Google Cloud
+// Storage bucket.
+type gcsCache struct {
+	bucket *storage.BucketHandle
+	prefix string
+}
+
+func newGCSCache(bucket, prefix string) (*gcsCache, error) {
+	client, err := storage.NewClient(context.Background(), option.WithScopes(storage.ScopeReadWrite))
+	if err != nil {
+		return nil, err
+	}
+
+	return &gcsCache{bucket: client.Bucket(bucket), prefix: prefix}, nil
+}
+
+func (c *gcsCache) Get(ctx context.Context, key string) ([]byte, error) {
+	r, err := c.bucket.Object(cacheKey(c.prefix, key)).NewReader(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil, autocert.ErrCacheMiss
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
+
+func (c *gcsCache) Put(ctx context.Context, key string, data []byte) error {
+	w := c.bucket.Object(cacheKey(c.prefix, key)).NewWriter(ctx)
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func (c *gcsCache) Delete(ctx context.Context, key string) error {
+	err := c.bucket.Object(cacheKey(c.prefix, key)).Delete(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil
+	}
+	return err
+}
+
+// s3Cache stores autocert cache entries as objects in an S3 bucket.
+type s3Cache struct {
+	client *s3.S3
+	bucket string
+	prefix string
+}
+
+func newS3Cache(bucket, prefix string) (*s3Cache, error) {
+	sess, err := session.NewSessionWithOptions(session.Options{SharedConfigState: session.SharedConfigEnable})
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3Cache{client: s3.New(sess), bucket: bucket, prefix: prefix}, nil
+}
+
+func (c *s3Cache) Get(ctx context.Context, key string) ([]byte, error) {
+	out, err := c.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(c.bucket),
+		Key:    aws.String(cacheKey(c.prefix, key)),
+	})
+	if isS3NotFound(err) {
+		return nil, autocert.ErrCacheMiss
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+
+	return ioutil.ReadAll(out.Body)
+}
+
+func (c *s3Cache) Put(ctx context.Context, key string, data []byte) error {
+	_, err := c.client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(c.bucket),
+		Key:    aws.String(cacheKey(c.prefix, key)),
+		Body:   bytes.NewReader(data),
+	})
+	return err
+}
+
+func (c *s3Cache) Delete(ctx context.Context, key string) error {
+	_, err := c.client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(c.bucket),
+		Key:    aws.String(cacheKey(c.prefix, key)),
+	})
+	return err
+}
+
+func isS3NotFound(err error) bool {
+	ae, ok := err.(awserr.Error)
+	return ok && (ae.Code() == s3.ErrCodeNoSuchKey || ae.Code() == "NotFound")
+}
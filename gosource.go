@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// goSourceContent builds the content attribute of a go-source meta tag
+// for repoName under prefix/repoRoot, using preset. preset is one of
+// "github", "gitea", "gitlab", "bitbucket", or "custom:<dir-template>
+// <file-template>" for repo hosts that don't match a preset. The {dir},
+// {/dir}, {file} and {line} placeholders are left intact for the go
+// tool itself to expand while walking subpackages; ok is false when
+// preset is empty or unrecognized, in which case no tag is emitted.
+func goSourceContent(prefix, repoRoot, repoName, preset string) (content string, ok bool) {
+	if len(preset) == 0 {
+		return "", false
+	}
+
+	root := repoRoot + "/" + repoName
+	importPath := prefix + "/" + repoName
+
+	var dirTpl, fileTpl string
+	switch {
+	case preset == "github" || preset == "gitea" || preset == "gitlab":
+		dirTpl = root + "/tree/master{/dir}"
+		fileTpl = root + "/blob/master{/dir}/{file}#L{line}"
+	case preset == "bitbucket":
+		dirTpl = root + "/src/master{/dir}"
+		fileTpl = root + "/src/master{/dir}/{file}#{file}-{line}"
+	case strings.HasPrefix(preset, "custom:"):
+		parts := strings.SplitN(strings.TrimPrefix(preset, "custom:"), " ", 2)
+		if len(parts) != 2 {
+			return "", false
+		}
+		dirTpl = strings.Replace(parts[0], "{root}", root, -1)
+		fileTpl = strings.Replace(parts[1], "{root}", root, -1)
+	default:
+		return "", false
+	}
+
+	return fmt.Sprintf("%s %s %s %s", importPath, root, dirTpl, fileTpl), true
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// listenFDsStart is SD_LISTEN_FDS_START, the first file descriptor
+// number systemd/launchd pass to a socket-activated process.
+const listenFDsStart = 3
+
+// systemdListeners returns the listeners passed to this process via the
+// systemd/launchd LISTEN_FDS/LISTEN_PID socket activation protocol, or
+// nil if the process was started normally. When present, they are used
+// in place of net.Listen so the process can bind :80/:443 without root
+// and restart without dropping connections.
+func systemdListeners() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+
+	listeners := make([]net.Listener, n)
+	for i := 0; i < n; i++ {
+		fd := listenFDsStart + i
+		f := os.NewFile(uintptr(fd), fmt.Sprintf("listen-fd-%d", fd))
+
+		l, err := net.FileListener(f)
+		if err != nil {
+			return nil, fmt.Errorf("gopkgredir: inherited listener fd %d: %v", fd, err)
+		}
+		listeners[i] = l
+	}
+
+	return listeners, nil
+}
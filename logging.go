@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+var logger *slog.Logger
+
+// newLogger builds the process-wide structured logger from the
+// --log-format/--log-level flags.
+func newLogger(format, level string) *slog.Logger {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		lvl = slog.LevelInfo
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	var h slog.Handler
+	if format == "text" {
+		h = slog.NewTextHandler(os.Stderr, opts)
+	} else {
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	}
+
+	return slog.New(h)
+}
+
+// reqInfo carries request details resolved deep inside handler() back
+// out to loggingMiddleware, which wraps it and runs after it returns.
+// host and repoLabel are bounded label values (see hostLabel/repoLabel),
+// not the raw request Host/path, so they're safe to use as metric
+// labels; repo holds the actual resolved repo name for the access log.
+type reqInfo struct {
+	host      string
+	repo      string
+	repoLabel string
+}
+
+type reqInfoKey struct{}
+
+func withReqInfo(r *http.Request) (*http.Request, *reqInfo) {
+	info := &reqInfo{}
+	return r.WithContext(context.WithValue(r.Context(), reqInfoKey{}, info)), info
+}
+
+func reqInfoFromContext(ctx context.Context) *reqInfo {
+	info, _ := ctx.Value(reqInfoKey{}).(*reqInfo)
+	return info
+}
+
+// statusWriter records the status code written through an
+// http.ResponseWriter so middleware can observe it after the fact.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// hostLabel bounds the "host" metric label to the configured site's own
+// Host (or "default" for the host-less catch-all site, "unknown" when
+// no site matched), instead of echoing the client-supplied Host header,
+// which would let an attacker grow the metric vector without bound.
+func hostLabel(s site, matched bool) string {
+	if !matched {
+		return "unknown"
+	}
+	if len(s.Host) == 0 {
+		return "default"
+	}
+	return s.Host
+}
+
+// repoLabel bounds the "repo" metric label to "known"/"unknown" against
+// s.Overrides instead of echoing the client-supplied first path
+// segment, which is otherwise an arbitrary, arbitrarily-long string.
+func repoLabel(s site, repoName string) string {
+	if len(repoName) == 0 {
+		return ""
+	}
+	if _, ok := s.Overrides[repoName]; ok {
+		return "known"
+	}
+	return "unknown"
+}
+
+// loggingMiddleware wraps next with structured access logging and
+// Prometheus request metrics, keyed on the repo handler() resolved (if
+// any) via the request's reqInfo.
+func loggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		r, info := withReqInfo(r)
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(sw, r)
+
+		elapsed := time.Since(start)
+
+		logger.Info("request",
+			"remote_addr", r.RemoteAddr,
+			"host", r.Host,
+			"path", r.URL.Path,
+			"repo", info.repo,
+			"user_agent", r.UserAgent(),
+			"status", sw.status,
+			"duration", elapsed.String(),
+		)
+
+		// Metric labels must stay bounded regardless of what the client
+		// sends, so they use info.host/info.repoLabel (a fixed, known
+		// set of values) rather than the raw r.Host/path used above for
+		// logs.
+		if len(cfg.MetricsListenAddress) > 0 {
+			requestsTotal.WithLabelValues(info.host, info.repoLabel, strconv.Itoa(sw.status)).Inc()
+			requestDuration.WithLabelValues(info.host).Observe(elapsed.Seconds())
+		}
+	})
+}
@@ -1,24 +1,34 @@
 package main // import "jrubin.io/gopkgredir"
 
 import (
+	"context"
 	"crypto/tls"
 	"html/template"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/codegangsta/cli"
-	"github.com/rsc/letsencrypt"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
 )
 
+const metaTpl = `<meta http-equiv="Content-Type" content="text/html; charset=utf-8"/>
+<meta name="go-import" content="{{.ImportPrefix}}/{{.RepoName}} {{.VCS}} {{.RepoRoot}}/{{.RepoName}}" >
+{{if .GoSource}}<meta name="go-source" content="{{.GoSource}}">
+{{end}}`
+
 const tpl = `<!DOCTYPE html>
 <html>
 <head>
-<meta http-equiv="Content-Type" content="text/html; charset=utf-8"/>
-<meta name="go-import" content="{{.ImportPrefix}}/{{.RepoName}} {{.VCS}} {{.RepoRoot}}/{{.RepoName}}" >
-<meta http-equiv="refresh" content="0; url={{.RedirectURL}}">
+` + metaTpl + `<meta http-equiv="refresh" content="0; url={{.RedirectURL}}">
 </head>
 <body>
 Nothing to see here; <a href="{{.RedirectURL}}">move along</a>.
@@ -26,10 +36,31 @@ Nothing to see here; <a href="{{.RedirectURL}}">move along</a>.
 </html>
 `
 
+// goGetTpl is served when the go tool itself is requesting the page
+// (?go-get=1); it carries the same meta tags without the browser
+// refresh/redirect, since the go tool never follows or renders either.
+const goGetTpl = `<!DOCTYPE html>
+<html>
+<head>
+` + metaTpl + `</head>
+<body>
+</body>
+</html>
+`
+
 const (
 	htmlTplName             = "html"
+	goGetTplName            = "goget"
 	defaultListenAddress    = "[::1]:80"
 	defaultTLSListenAddress = "[::1]:443"
+	defaultShutdownTimeout  = 15 * time.Second
+
+	defaultHTTP2MaxConcurrentStreams = 250
+	defaultHTTP2IdleTimeout          = 5 * time.Minute
+
+	defaultLogFormat        = "json"
+	defaultLogLevel         = "info"
+	certExpiryCheckInterval = time.Hour
 )
 
 type config struct {
@@ -37,28 +68,43 @@ type config struct {
 	VCS              string
 	RepoRoot         string
 	RedirectURL      string
+	SourceTemplate   string
 	ListenAddress    string
 	TLSListenAddress string
 	PublicTLSAddress string
 	TLS              bool
+	ShutdownTimeout  time.Duration
+
+	HTTP2MaxConcurrentStreams uint32
+	HTTP2IdleTimeout          time.Duration
+	HTTP3                     bool
+
+	LogFormat            string
+	LogLevel             string
+	MetricsListenAddress string
 }
 
-type context struct {
-	config
+type pageContext struct {
+	site
 	RepoName    string
 	RedirectURL string
+	GoSource    string
 }
 
 var (
-	name, version string
-	html          *template.Template
-	cfg           config
-	manager       letsencrypt.Manager
-	app           = cli.NewApp()
+	name, version   string
+	html            *template.Template
+	cfg             config
+	sites           siteSet
+	manager         autocert.Manager
+	autocertCache   autocert.Cache
+	configuredHosts []string
+	app             = cli.NewApp()
 )
 
 func init() {
 	html = template.Must(template.New(htmlTplName).Parse(tpl))
+	template.Must(html.New(goGetTplName).Parse(goGetTpl))
 
 	app.Name = name
 	app.Version = version
@@ -91,6 +137,16 @@ func init() {
 			EnvVar: "REDIRECT_URL",
 			Usage:  "url to redirect browsers to, if empty, redirects to repo-root/package",
 		},
+		cli.StringFlag{
+			Name:   "source-template",
+			EnvVar: "SOURCE_TEMPLATE",
+			Usage:  "emit a go-source meta tag using this preset: github, gitea, gitlab, bitbucket, or custom:<dir-template> <file-template>",
+		},
+		cli.StringFlag{
+			Name:   "config",
+			EnvVar: "CONFIG_FILE",
+			Usage:  "path to a YAML file describing multiple host/import-prefix/vcs/repo-root sites; overrides import-prefix/vcs/repo-root/redirect-url",
+		},
 		cli.StringFlag{
 			Name:   "tls-listen-address",
 			EnvVar: "TLS_LISTEN_ADDRESS",
@@ -104,15 +160,21 @@ func init() {
 			Usage:  "address (ip/hostname and port) that the server should listen on to redirect to the public tls address",
 		},
 		cli.StringFlag{
-			Name:   "cache-file",
-			EnvVar: "LETSENCRYPT_CACHE_FILE",
-			Value:  "letsencrypt.cache",
-			Usage:  "file to use as the letsencrypt cache",
+			Name:   "cache-backend",
+			EnvVar: "CACHE_BACKEND",
+			Value:  "autocert-cache",
+			Usage:  "where to store acme account/certificate state: a filesystem directory (default), or \"gcs://bucket/prefix\" or \"s3://bucket/prefix\"",
 		},
 		cli.StringFlag{
 			Name:   "email",
 			EnvVar: "LETSENCRYPT_EMAIL",
-			Usage:  "email address to use for registering with letsencrypt",
+			Usage:  "email address to use for registering with the acme ca",
+		},
+		cli.StringFlag{
+			Name:   "acme-directory",
+			EnvVar: "ACME_DIRECTORY",
+			Value:  acme.LetsEncryptURL,
+			Usage:  "acme directory url, use the letsencrypt staging directory to test without hitting production rate limits",
 		},
 		cli.StringFlag{
 			Name:   "public-tls-address",
@@ -124,6 +186,46 @@ func init() {
 			EnvVar: "NO_TLS",
 			Usage:  "set this flag to disable tls support and listen only on \"listen-address\" without tls redirection",
 		},
+		cli.DurationFlag{
+			Name:   "shutdown-timeout",
+			EnvVar: "SHUTDOWN_TIMEOUT",
+			Value:  defaultShutdownTimeout,
+			Usage:  "how long to wait for in-flight requests to drain on SIGINT/SIGTERM before the process exits",
+		},
+		cli.IntFlag{
+			Name:   "http2-max-concurrent-streams",
+			EnvVar: "HTTP2_MAX_CONCURRENT_STREAMS",
+			Value:  defaultHTTP2MaxConcurrentStreams,
+			Usage:  "maximum concurrent http/2 streams per connection on the tls listener",
+		},
+		cli.DurationFlag{
+			Name:   "http2-idle-timeout",
+			EnvVar: "HTTP2_IDLE_TIMEOUT",
+			Value:  defaultHTTP2IdleTimeout,
+			Usage:  "how long an idle http/2 connection is kept open on the tls listener",
+		},
+		cli.BoolFlag{
+			Name:   "http3",
+			EnvVar: "HTTP3",
+			Usage:  "also listen for http/3 (quic) on the tls listener's port (udp) and advertise it via Alt-Svc",
+		},
+		cli.StringFlag{
+			Name:   "log-format",
+			EnvVar: "LOG_FORMAT",
+			Value:  defaultLogFormat,
+			Usage:  "access log format: json or text",
+		},
+		cli.StringFlag{
+			Name:   "log-level",
+			EnvVar: "LOG_LEVEL",
+			Value:  defaultLogLevel,
+			Usage:  "minimum level to log: debug, info, warn, or error",
+		},
+		cli.StringFlag{
+			Name:   "metrics-listen-address",
+			EnvVar: "METRICS_LISTEN_ADDRESS",
+			Usage:  "address (ip/hostname and port) to serve Prometheus metrics on at /metrics; disabled if empty",
+		},
 	}
 }
 
@@ -139,56 +241,207 @@ func setup(c *cli.Context) error {
 		VCS:              c.String("vcs"),
 		RepoRoot:         c.String("repo-root"),
 		RedirectURL:      c.String("redirect-url"),
+		SourceTemplate:   c.String("source-template"),
 		ListenAddress:    c.String("listen-address"),
 		TLSListenAddress: c.String("tls-listen-address"),
 		PublicTLSAddress: c.String("public-tls-address"),
 		TLS:              !c.Bool("no-tls"),
+		ShutdownTimeout:  c.Duration("shutdown-timeout"),
+
+		HTTP2MaxConcurrentStreams: uint32(c.Int("http2-max-concurrent-streams")),
+		HTTP2IdleTimeout:          c.Duration("http2-idle-timeout"),
+		HTTP3:                     c.Bool("http3"),
+
+		LogFormat:            c.String("log-format"),
+		LogLevel:             c.String("log-level"),
+		MetricsListenAddress: c.String("metrics-listen-address"),
+	}
+
+	logger = newLogger(cfg.LogFormat, cfg.LogLevel)
+
+	loaded, err := loadSites(c.String("config"), cfg)
+	if err != nil {
+		return err
 	}
+	sites, err = newSiteSet(loaded)
+	if err != nil {
+		return err
+	}
+	configuredHosts = siteHosts(loaded)
 
 	if cfg.TLS {
-		if err := manager.CacheFile(c.String("cache-file")); err != nil {
+		cache, err := newAutocertCache(c.String("cache-backend"))
+		if err != nil {
 			return err
 		}
+		autocertCache = cache
 
-		if email := c.String("email"); len(email) > 0 {
-			if err := manager.Register(email, nil); err != nil {
-				return err
-			}
+		manager = autocert.Manager{
+			Prompt: autocert.AcceptTOS,
+			Cache:  cache,
+			Email:  c.String("email"),
+			Client: &acme.Client{DirectoryURL: c.String("acme-directory")},
+		}
+
+		// Restrict issuance to the configured hostnames, including the
+		// one loadSites derives from --import-prefix for legacy
+		// single-prefix deployments. This is empty only when no site has
+		// a host (such as a single-prefix deployment with an empty
+		// prefix), in which case any hostname is accepted.
+		if len(configuredHosts) > 0 {
+			manager.HostPolicy = autocert.HostWhitelist(configuredHosts...)
 		}
 	}
 
 	return nil
 }
 
+// siteHosts returns the non-empty hosts of the configured sites, used to
+// restrict autocert to the hostnames this process is actually meant to
+// serve.
+func siteHosts(sites []site) []string {
+	hosts := make([]string, 0, len(sites))
+	for _, s := range sites {
+		if len(s.Host) > 0 {
+			hosts = append(hosts, s.Host)
+		}
+	}
+	return hosts
+}
+
 func run(c *cli.Context) error {
+	inherited, err := systemdListeners()
+	if err != nil {
+		return err
+	}
+
+	var httpListener, tlsListener net.Listener
+	switch {
+	case len(inherited) == 1:
+		if cfg.TLS {
+			tlsListener = inherited[0]
+		} else {
+			httpListener = inherited[0]
+		}
+	case len(inherited) >= 2:
+		httpListener, tlsListener = inherited[0], inherited[1]
+	}
+
+	if httpListener == nil {
+		httpListener, err = net.Listen("tcp", cfg.ListenAddress)
+		if err != nil {
+			return err
+		}
+	}
+
+	httpHandler := http.Handler(http.HandlerFunc(redirectHTTP))
 	if !cfg.TLS {
-		log.Printf("listening for http at %s", cfg.ListenAddress)
-		return http.ListenAndServe(cfg.ListenAddress, handler())
+		httpHandler = handler()
 	}
+	httpHandler = loggingMiddleware(httpHandler)
 
-	l, err := net.Listen("tcp", cfg.ListenAddress)
-	if err != nil {
+	servers := []*http.Server{{Handler: httpHandler}}
+	var http3Srv *http3.Server
+	errCh := make(chan error, 4)
+
+	log.Printf("listening for http at %s", httpListener.Addr())
+	go func() { errCh <- servers[0].Serve(httpListener) }()
+
+	shutdownCtx, cancelShutdownCtx := context.WithCancel(context.Background())
+	defer cancelShutdownCtx()
+
+	if cfg.TLS && len(cfg.MetricsListenAddress) > 0 && len(configuredHosts) > 0 {
+		go watchCertExpiry(shutdownCtx, autocertCache, configuredHosts, certExpiryCheckInterval)
+	}
+
+	if len(cfg.MetricsListenAddress) > 0 {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		metricsSrv := &http.Server{Handler: mux}
+
+		metricsListener, err := net.Listen("tcp", cfg.MetricsListenAddress)
+		if err != nil {
+			return err
+		}
+		servers = append(servers, metricsSrv)
+
+		log.Printf("listening for metrics at %s", metricsListener.Addr())
+		go func() { errCh <- metricsSrv.Serve(metricsListener) }()
+	}
+
+	if cfg.TLS {
+		if tlsListener == nil {
+			tlsListener, err = net.Listen("tcp", cfg.TLSListenAddress)
+			if err != nil {
+				return err
+			}
+		}
+
+		tlsHandler := loggingMiddleware(handler())
+		if cfg.HTTP3 {
+			tlsHandler = withAltSvc(tlsHandler, cfg.TLSListenAddress)
+		}
+
+		tlsSrv := &http.Server{
+			TLSConfig: &tls.Config{GetCertificate: manager.GetCertificate},
+			Handler:   tlsHandler,
+		}
+		if err := configureHTTP2(tlsSrv, cfg.HTTP2MaxConcurrentStreams, cfg.HTTP2IdleTimeout); err != nil {
+			return err
+		}
+		servers = append(servers, tlsSrv)
+
+		log.Printf("listening for tls at %s", tlsListener.Addr())
+		go func() { errCh <- tlsSrv.ServeTLS(tlsListener, "", "") }()
+
+		if cfg.HTTP3 {
+			http3Srv = &http3.Server{
+				Addr:      cfg.TLSListenAddress,
+				TLSConfig: tlsSrv.TLSConfig,
+				Handler:   tlsHandler,
+			}
+
+			log.Printf("listening for http/3 at %s", cfg.TLSListenAddress)
+			go func() { errCh <- http3Srv.ListenAndServe() }()
+		}
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+
+	select {
+	case err := <-errCh:
 		return err
+	case s := <-sig:
+		log.Printf("received %s, draining for up to %s", s, cfg.ShutdownTimeout)
 	}
-	defer func() {
-		if err := l.Close(); err != nil {
-			log.Printf("error closing http listener: %v\n", err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("error shutting down server: %v", err)
 		}
-	}()
+	}
 
-	log.Printf("listening for http at %s", cfg.ListenAddress)
-	go func() {
-		if err := http.Serve(l, http.HandlerFunc(redirectHTTP)); err != nil {
-			log.Printf("error starting http listener: %v\n", err)
+	if http3Srv != nil {
+		if err := http3Srv.Close(); err != nil {
+			log.Printf("error closing http3 server: %v", err)
 		}
-	}()
+	}
 
-	return serveHTTPS()
+	return nil
 }
 
 func redirectHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.TLS != nil || r.Host == "" {
 		http.Error(w, "not found", 404)
+		return
+	}
+
+	if info := reqInfoFromContext(r.Context()); info != nil {
+		info.host = "redirect-http"
 	}
 
 	u := r.URL
@@ -197,38 +450,58 @@ func redirectHTTP(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, u.String(), 302)
 }
 
-func serveHTTPS() error {
-	srv := &http.Server{
-		Addr: cfg.TLSListenAddress,
-		TLSConfig: &tls.Config{
-			GetCertificate: manager.GetCertificate,
-		},
-		Handler: handler(),
-	}
-
-	log.Printf("listening for tls at %s", cfg.TLSListenAddress)
-	return srv.ListenAndServeTLS("", "")
-}
-
 func handler() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ctx := context{
-			config:      cfg,
-			RedirectURL: cfg.RedirectURL,
+		host := r.URL.Hostname()
+		if len(host) == 0 {
+			if h, _, err := net.SplitHostPort(r.Host); err == nil {
+				host = h
+			} else {
+				host = r.Host
+			}
+		}
+
+		s, ok := sites.lookup(host)
+		if info := reqInfoFromContext(r.Context()); info != nil {
+			info.host = hostLabel(s, ok)
+		}
+		if !ok {
+			http.NotFound(w, r)
+			return
 		}
 
+		var repoName string
 		pkg := strings.Split(r.URL.Path, "/")
 		if len(pkg) > 1 {
-			ctx.RepoName = pkg[1]
+			repoName = pkg[1]
+			if o, matched := s.forRequest(repoName); matched {
+				s = o
+			}
+		}
+
+		if info := reqInfoFromContext(r.Context()); info != nil {
+			info.repo = repoName
+			info.repoLabel = repoLabel(s, repoName)
+		}
 
-			if len(cfg.RedirectURL) == 0 {
-				ctx.RedirectURL = ctx.RepoRoot + "/" + pkg[1]
+		ctx := pageContext{site: s, RepoName: repoName, RedirectURL: s.RedirectURL}
+		if len(ctx.RedirectURL) == 0 && len(repoName) > 0 {
+			ctx.RedirectURL = s.RepoRoot + "/" + repoName
+		}
+		if len(repoName) > 0 {
+			if src, ok := goSourceContent(s.ImportPrefix, s.RepoRoot, repoName, s.SourceTemplate); ok {
+				ctx.GoSource = src
 			}
 		}
 
+		tplName := htmlTplName
+		if r.URL.Query().Get("go-get") == "1" {
+			tplName = goGetTplName
+		}
+
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
 
-		if err := html.ExecuteTemplate(w, htmlTplName, ctx); err != nil {
+		if err := html.ExecuteTemplate(w, tplName, ctx); err != nil {
 			log.Println("error executing template", err)
 		}
 	})
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gopkgredir_requests_total",
+		Help: "Total number of HTTP requests handled, by host, repo (known or unknown override), and status code.",
+	}, []string{"host", "repo", "status"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gopkgredir_request_duration_seconds",
+		Help:    "HTTP request latency in seconds, by host.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"host"})
+
+	certExpiry = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gopkgredir_tls_cert_expiry_seconds",
+		Help: "Unix timestamp, in seconds, that the cached TLS certificate for domain expires.",
+	}, []string{"domain"})
+)
+
+func init() {
+	prometheus.MustRegister(requestsTotal, requestDuration, certExpiry)
+}
+
+// leafCertificate finds and parses the CERTIFICATE block in an
+// autocert cache entry. autocert writes the private key block before
+// the certificate block(s), so the first PEM block is never it.
+func leafCertificate(data []byte) (*x509.Certificate, bool) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, false
+		}
+
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, false
+		}
+
+		return cert, true
+	}
+}
+
+// watchCertExpiry periodically reads each host's cached autocert
+// certificate and publishes its expiry, until ctx is canceled.
+func watchCertExpiry(ctx context.Context, cache autocert.Cache, hosts []string, interval time.Duration) {
+	refresh := func() {
+		for _, host := range hosts {
+			data, err := cache.Get(ctx, host)
+			if err != nil {
+				continue
+			}
+
+			cert, ok := leafCertificate(data)
+			if !ok {
+				continue
+			}
+
+			certExpiry.WithLabelValues(host).Set(float64(cert.NotAfter.Unix()))
+		}
+	}
+
+	refresh()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			refresh()
+		}
+	}
+}
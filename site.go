@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// siteOverride customizes the vcs/repo-root/redirect-url of a site for a
+// single top-level package, keyed by the first path segment after the
+// import prefix.
+type siteOverride struct {
+	VCS            string `yaml:"vcs"`
+	RepoRoot       string `yaml:"repo-root"`
+	RedirectURL    string `yaml:"redirect-url"`
+	SourceTemplate string `yaml:"source-template"`
+}
+
+// site describes a single vanity import prefix served by this process.
+// A process may serve many sites at once, dispatched on the request
+// host, so that one binary can front several vanity domains.
+type site struct {
+	Host           string                  `yaml:"host"`
+	ImportPrefix   string                  `yaml:"import-prefix"`
+	VCS            string                  `yaml:"vcs"`
+	RepoRoot       string                  `yaml:"repo-root"`
+	RedirectURL    string                  `yaml:"redirect-url"`
+	SourceTemplate string                  `yaml:"source-template"`
+	Overrides      map[string]siteOverride `yaml:"overrides"`
+}
+
+// fileConfig is the top level shape of the --config/CONFIG_FILE document.
+type fileConfig struct {
+	Sites []site `yaml:"sites"`
+}
+
+// loadSites reads and parses a multi-site config file. When path is
+// empty, it returns a single site built from the legacy command line
+// flags, with its Host taken from the import prefix; requests for any
+// other host are then not served.
+func loadSites(path string, legacy config) ([]site, error) {
+	if len(path) == 0 {
+		return []site{{
+			Host:           hostFromImportPrefix(legacy.ImportPrefix),
+			ImportPrefix:   legacy.ImportPrefix,
+			VCS:            legacy.VCS,
+			RepoRoot:       legacy.RepoRoot,
+			RedirectURL:    legacy.RedirectURL,
+			SourceTemplate: legacy.SourceTemplate,
+		}}, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var fc fileConfig
+	if err := yaml.Unmarshal(b, &fc); err != nil {
+		return nil, err
+	}
+
+	if len(fc.Sites) == 0 {
+		return nil, fmt.Errorf("gopkgredir: no sites defined in %s", path)
+	}
+
+	return fc.Sites, nil
+}
+
+// hostFromImportPrefix extracts the hostname a legacy --import-prefix
+// refers to, so the single-site deployment path still has a Host for
+// the autocert HostPolicy whitelist to restrict issuance to.
+func hostFromImportPrefix(importPrefix string) string {
+	host := importPrefix
+	if i := strings.Index(host, "://"); i >= 0 {
+		host = host[i+len("://"):]
+	}
+	if i := strings.IndexByte(host, '/'); i >= 0 {
+		host = host[:i]
+	}
+	return host
+}
+
+// forRequest resolves the per-package override, if any, that applies to
+// pkg (the first path segment of the request) and returns the
+// effective site along with whether an override was applied.
+func (s site) forRequest(pkg string) (site, bool) {
+	o, ok := s.Overrides[pkg]
+	if !ok {
+		return s, false
+	}
+
+	if len(o.VCS) > 0 {
+		s.VCS = o.VCS
+	}
+	if len(o.RepoRoot) > 0 {
+		s.RepoRoot = o.RepoRoot
+	}
+	if len(o.RedirectURL) > 0 {
+		s.RedirectURL = o.RedirectURL
+	}
+	if len(o.SourceTemplate) > 0 {
+		s.SourceTemplate = o.SourceTemplate
+	}
+
+	return s, true
+}
+
+// siteSet indexes configured sites by host for dispatch in handler().
+type siteSet map[string]site
+
+// newSiteSet indexes sites by host, rejecting configs that define the
+// same host (or no host) more than once,
+// since that would silently drop one of the sites from being served.
+func newSiteSet(sites []site) (siteSet, error) {
+	set := make(siteSet, len(sites))
+	for _, s := range sites {
+		if _, exists := set[s.Host]; exists {
+			if len(s.Host) == 0 {
+				return nil, fmt.Errorf("gopkgredir: more than one site configured with no host")
+			}
+			return nil, fmt.Errorf("gopkgredir: duplicate site host %q", s.Host)
+		}
+		set[s.Host] = s
+	}
+	return set, nil
+}
+
+// lookup finds the site configured for host, falling back to the
+// host-less entry, if one is configured (a catch-all site, or a
+// single-site deployment with an empty import prefix).
+func (set siteSet) lookup(host string) (site, bool) {
+	if s, ok := set[host]; ok {
+		return s, true
+	}
+
+	s, ok := set[""]
+	return s, ok
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// configureHTTP2 enables HTTP/2 on srv with the configured concurrency
+// and idle timeout limits. srv.TLSConfig must already be set.
+func configureHTTP2(srv *http.Server, maxConcurrentStreams uint32, idleTimeout time.Duration) error {
+	return http2.ConfigureServer(srv, &http2.Server{
+		MaxConcurrentStreams: maxConcurrentStreams,
+		IdleTimeout:          idleTimeout,
+	})
+}
+
+// withAltSvc advertises HTTP/3 support on addr's port via the Alt-Svc
+// response header, so clients that already speak h3 can switch to it on
+// the next request.
+func withAltSvc(next http.Handler, addr string) http.Handler {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		port = "443"
+	}
+
+	altSvc := fmt.Sprintf(`h3=":%s"; ma=2592000`, port)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Alt-Svc", altSvc)
+		next.ServeHTTP(w, r)
+	})
+}